@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// hllPrecision is the number of bits of each hash used as the HyperLogLog
+// register index. 14 bits gives 16384 registers and ~0.8% standard error.
+const hllPrecision = 14
+const hllRegisterCount = 1 << hllPrecision
+
+// hyperLogLog is a HyperLogLog++ cardinality sketch over 32-bit record IDs.
+// It trades exact counting for O(1) memory: 16384 single-byte registers
+// regardless of how many records are added.
+type hyperLogLog struct {
+	mu        sync.Mutex
+	registers [hllRegisterCount]uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{}
+}
+
+// add hashes id to a 64-bit value, uses the top hllPrecision bits as the
+// register index and the position of the leading 1 in the remaining bits as
+// the register value, keeping the max seen per register.
+func (h *hyperLogLog) add(id uint32) {
+	hash := hashRecordID(id)
+	index := hash >> (64 - hllPrecision)
+	rest := hash << hllPrecision
+
+	rho := uint8(bits.LeadingZeros64(rest)) + 1
+	if rho > 64-hllPrecision+1 {
+		rho = 64 - hllPrecision + 1
+	}
+
+	h.mu.Lock()
+	if rho > h.registers[index] {
+		h.registers[index] = rho
+	}
+	h.mu.Unlock()
+}
+
+// estimate returns the cardinality estimate via the standard harmonic-mean
+// formula, falling back to linear counting when many registers are still
+// zero (small-range correction).
+func (h *hyperLogLog) estimate() float64 {
+	h.mu.Lock()
+	registers := h.registers
+	h.mu.Unlock()
+
+	m := float64(hllRegisterCount)
+	sum := 0.0
+	zeros := 0
+	for _, r := range registers {
+		sum += 1.0 / math.Pow(2, float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return estimate
+}
+
+func hashRecordID(id uint32) uint64 {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], id)
+	return xxhash.Sum64(buf[:])
+}
+
+// bloomFilter is a fixed-size Bloom filter sized for a target false-positive
+// rate, used to estimate duplicates without storing every record ID.
+type bloomFilter struct {
+	mu   sync.Mutex
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// newBloomFilter sizes the filter for n expected insertions at the given
+// false-positive rate, using the standard m = -n*ln(p)/ln(2)^2 and
+// k = round(m/n * ln(2)) formulas.
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	if n <= 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-1 * float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if m == 0 {
+		m = 1
+	}
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+
+	return &bloomFilter{
+		bits: make([]uint64, (m/64)+1),
+		m:    m,
+		k:    k,
+	}
+}
+
+// addAndTest inserts id using Kirsch-Mitzenmacher double hashing and returns
+// whether it was "possibly present" before insertion, i.e. a probable
+// duplicate.
+func (b *bloomFilter) addAndTest(id uint32) bool {
+	var buf [5]byte
+	binary.LittleEndian.PutUint32(buf[:4], id)
+	h1 := xxhash.Sum64(buf[:4])
+	buf[4] = 0xff
+	h2 := xxhash.Sum64(buf[:])
+
+	possiblyPresent := true
+	b.mu.Lock()
+	for i := uint64(0); i < b.k; i++ {
+		combined := (h1 + i*h2) % b.m
+		word, bit := combined/64, combined%64
+		if b.bits[word]&(1<<bit) == 0 {
+			possiblyPresent = false
+			b.bits[word] |= 1 << bit
+		}
+	}
+	b.mu.Unlock()
+
+	return possiblyPresent
+}
+
+// approximateConfig holds the -mode/-exact-threshold flag values plus the
+// sketches built for the run (the -bloom-fpr value only sizes the Bloom
+// filter and is not kept here).
+type approximateConfig struct {
+	mode              string
+	exactThreshold    int
+	useExact          bool
+	hll               *hyperLogLog
+	bloom             *bloomFilter
+	duplicateEstimate int64
+}
+
+var approxConfig approximateConfig
+
+// initApproximateTracking builds the HLL and Bloom sketches for a run of
+// inputRecord records. useExact is set when the run is small enough (under
+// -exact-threshold) to also maintain the exact inputMap for comparison.
+func initApproximateTracking(inputRecord int, bloomFpr float64) {
+	approxConfig.hll = newHyperLogLog()
+	approxConfig.bloom = newBloomFilter(inputRecord, bloomFpr)
+	approxConfig.useExact = inputRecord < approxConfig.exactThreshold
+}
+
+// recordSeen is the single entry point for "this record ID was observed"
+// bookkeeping, called from every destination. In exact mode it just merges
+// into inputMap. In approximate mode it always updates the HLL and Bloom
+// sketches, and only also merges into inputMap when the run is small enough
+// to keep exact counts around for comparison.
+func recordSeen(id uint32) {
+	if approxConfig.mode == "approximate" {
+		approxConfig.hll.add(id)
+		if approxConfig.bloom.addAndTest(id) {
+			atomic.AddInt64(&approxConfig.duplicateEstimate, 1)
+		}
+		if !approxConfig.useExact {
+			return
+		}
+	}
+
+	inputMapMu.Lock()
+	inputMap[id] = struct{}{}
+	inputMapMu.Unlock()
+}
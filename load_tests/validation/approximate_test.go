@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+// TestHyperLogLogEstimateAccuracy checks that the HLL estimate for a known
+// cardinality stays within the ~0.8% standard error claimed in approximate.go
+// for hllPrecision=14, with slack for the randomness of a single trial.
+func TestHyperLogLogEstimateAccuracy(t *testing.T) {
+	const n = 1000000
+
+	hll := newHyperLogLog()
+	for i := uint32(0); i < n; i++ {
+		hll.add(idCounterBase + i)
+	}
+
+	estimate := hll.estimate()
+	errorRate := (estimate - n) / n
+	if errorRate < 0 {
+		errorRate = -errorRate
+	}
+
+	const maxErrorRate = 0.03
+	if errorRate > maxErrorRate {
+		t.Errorf("estimate %.0f for n=%d has error rate %.4f, want <= %.4f", estimate, n, errorRate, maxErrorRate)
+	}
+}
+
+// TestBloomFilterAddAndTest checks that addAndTest reports new ids as
+// duplicates on first insertion no more often than the false-positive rate the
+// filter was sized for, and reports every id as a duplicate on every later
+// insertion (a Bloom filter has no false negatives).
+func TestBloomFilterAddAndTest(t *testing.T) {
+	const n = 10000
+	const falsePositiveRate = 0.01
+
+	bloom := newBloomFilter(n, falsePositiveRate)
+
+	falsePositives := 0
+	for i := uint32(0); i < n; i++ {
+		if bloom.addAndTest(idCounterBase + i) {
+			falsePositives++
+		}
+	}
+	if maxFalsePositives := int(n * falsePositiveRate); falsePositives > maxFalsePositives {
+		t.Fatalf("%d of %d ids reported as duplicate on first insertion, want <= %d", falsePositives, n, maxFalsePositives)
+	}
+
+	for i := uint32(0); i < n; i++ {
+		if !bloom.addAndTest(idCounterBase + i) {
+			t.Fatalf("id %d not reported as duplicate on second insertion", idCounterBase+i)
+		}
+	}
+}
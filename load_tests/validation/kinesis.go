@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Creates a new Kinesis Data Streams Client
+func getKinesisClient(region string) (*kinesis.Kinesis, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return kinesis.New(sess), nil
+}
+
+// Creates a new Kinesis Firehose Client
+func getFirehoseClient(region string) (*firehose.Firehose, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return firehose.New(sess), nil
+}
+
+// validate_kinesis reads every shard of a Kinesis Data Stream in parallel,
+// starting from TRIM_HORIZON, and merges the record IDs it finds into
+// inputMap. A shard is considered drained once it reports zero
+// MillisBehindLatest and produces no new records for shardIdleTimeout.
+func validate_kinesis(kinesisClient *kinesis.Kinesis, streamName string, shardIdleTimeout time.Duration) int {
+	shards, err := listShards(kinesisClient, streamName)
+	if err != nil {
+		exitErrorf("[TEST FAILURE] Error occurred listing shards for stream: %q., %v", streamName, err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	recordCounter := 0
+
+	for _, shardId := range shards {
+		wg.Add(1)
+		go func(shardId string) {
+			defer wg.Done()
+			n := readShard(kinesisClient, streamName, shardId, shardIdleTimeout)
+			mu.Lock()
+			recordCounter += n
+			mu.Unlock()
+		}(shardId)
+	}
+
+	wg.Wait()
+
+	return recordCounter
+}
+
+// listShards enumerates every shard ID in the stream via ListShards,
+// following NextToken pagination.
+func listShards(kinesisClient *kinesis.Kinesis, streamName string) ([]string, error) {
+	var shardIds []string
+	var nextToken *string
+
+	for {
+		input := &kinesis.ListShardsInput{}
+		if nextToken != nil {
+			input.NextToken = nextToken
+		} else {
+			input.StreamName = aws.String(streamName)
+		}
+
+		response, err := kinesisClient.ListShards(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, shard := range response.Shards {
+			shardIds = append(shardIds, aws.StringValue(shard.ShardId))
+		}
+
+		if response.NextToken == nil {
+			break
+		}
+		nextToken = response.NextToken
+	}
+
+	return shardIds, nil
+}
+
+// readShard pulls records from a single shard starting at TRIM_HORIZON until
+// it has caught up to the tip of the shard (MillisBehindLatest == 0) and seen
+// no new records for shardIdleTimeout. It returns the number of records
+// found in the shard.
+func readShard(kinesisClient *kinesis.Kinesis, streamName string, shardId string, shardIdleTimeout time.Duration) int {
+	iteratorInput := &kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(streamName),
+		ShardId:           aws.String(shardId),
+		ShardIteratorType: aws.String(kinesis.ShardIteratorTypeTrimHorizon),
+	}
+	iteratorOutput, err := kinesisClient.GetShardIterator(iteratorInput)
+	if err != nil {
+		exitErrorf("[TEST FAILURE] Error occurred getting shard iterator for shard: %q., %v", shardId, err)
+	}
+
+	shardIterator := iteratorOutput.ShardIterator
+	recordCounter := 0
+	lastNewRecordAt := time.Now()
+
+	for shardIterator != nil {
+		getRecordsInput := &kinesis.GetRecordsInput{
+			ShardIterator: shardIterator,
+			Limit:         aws.Int64(10000),
+		}
+		response, err := kinesisClient.GetRecords(getRecordsInput)
+		if err != nil {
+			exitErrorf("[TEST FAILURE] Error occurred getting records from shard: %q., %v", shardId, err)
+		}
+
+		if len(response.Records) > 0 {
+			lastNewRecordAt = time.Now()
+		}
+
+		for _, record := range response.Records {
+			if countKinesisRecord(record.Data) {
+				recordCounter++
+			}
+		}
+
+		caughtUp := aws.Int64Value(response.MillisBehindLatest) == 0
+		if caughtUp && time.Since(lastNewRecordAt) > shardIdleTimeout {
+			break
+		}
+
+		shardIterator = response.NextShardIterator
+		if caughtUp {
+			time.Sleep(time.Second)
+		}
+	}
+
+	return recordCounter
+}
+
+// countKinesisRecord parses a single Kinesis record payload (one JSON log
+// message per record) and merges its record ID into inputMap.
+func countKinesisRecord(data []byte) bool {
+	var message Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		fmt.Fprintln(diagOut(), "[TEST ERROR] Malform log entry. Unmarshal Error:", err)
+		return false
+	}
+
+	recordId := message.Log[:8]
+	value, err := strconv.ParseUint(recordId, 10, 32)
+	if err != nil {
+		fmt.Fprintln(diagOut(), "[TEST ERROR] Malform log entry. ParseUint Error:", err)
+		return false
+	}
+	recordIdUint := uint32(value)
+	recordSeen(recordIdUint)
+
+	return true
+}
+
+// validate_firehose handles the delivery-stream-with-S3-backup case: it
+// resolves the backing bucket/prefix via DescribeDeliveryStream and
+// delegates to the existing S3 validation path so merged record IDs stay
+// consistent with the other destinations.
+func validate_firehose(firehoseClient *firehose.Firehose, s3Client *s3.S3, deliveryStreamName string, prefix string, concurrency int) int {
+	describeInput := &firehose.DescribeDeliveryStreamInput{
+		DeliveryStreamName: aws.String(deliveryStreamName),
+	}
+	response, err := firehoseClient.DescribeDeliveryStream(describeInput)
+	if err != nil {
+		exitErrorf("[TEST FAILURE] Error occurred describing delivery stream: %q., %v", deliveryStreamName, err)
+	}
+
+	bucket, bucketPrefix, err := resolveFirehoseS3Destination(response.DeliveryStreamDescription)
+	if err != nil {
+		exitErrorf("[TEST FAILURE] Unable to resolve S3 backup destination for delivery stream: %q., %v", deliveryStreamName, err)
+	}
+
+	if prefix != "" {
+		bucketPrefix = bucketPrefix + prefix
+	}
+
+	return validate_s3(s3Client, bucket, bucketPrefix, concurrency)
+}
+
+// resolveFirehoseS3Destination extracts the backing bucket name and prefix
+// from a delivery stream's S3 (or extended S3) destination description.
+func resolveFirehoseS3Destination(description *firehose.DeliveryStreamDescription) (string, string, error) {
+	for _, dest := range description.Destinations {
+		if dest.ExtendedS3DestinationDescription != nil {
+			bucket, err := bucketNameFromArn(aws.StringValue(dest.ExtendedS3DestinationDescription.BucketARN))
+			if err != nil {
+				return "", "", err
+			}
+			return bucket, aws.StringValue(dest.ExtendedS3DestinationDescription.Prefix), nil
+		}
+		if dest.S3DestinationDescription != nil {
+			bucket, err := bucketNameFromArn(aws.StringValue(dest.S3DestinationDescription.BucketARN))
+			if err != nil {
+				return "", "", err
+			}
+			return bucket, aws.StringValue(dest.S3DestinationDescription.Prefix), nil
+		}
+	}
+
+	return "", "", fmt.Errorf("delivery stream has no S3 destination configured")
+}
+
+// bucketNameFromArn extracts the bucket name from an S3 bucket ARN of the
+// form "arn:aws:s3:::bucket-name".
+func bucketNameFromArn(bucketArn string) (string, error) {
+	parts := strings.SplitN(bucketArn, ":::", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", fmt.Errorf("malformed bucket ARN: %q", bucketArn)
+	}
+	return parts[1], nil
+}
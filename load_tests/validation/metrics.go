@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// benchmarkMetricsConfig holds the -metrics-* flag values, plus the run
+// context (region/destination/prefix) used as CloudWatch dimensions.
+type benchmarkMetricsConfig struct {
+	sink        string
+	namespace   string
+	addr        string
+	hold        time.Duration
+	region      string
+	destination string
+	prefix      string
+}
+
+var metricsConfig benchmarkMetricsConfig
+
+// benchmarkMetrics is the set of values get_results reports through
+// whichever -metrics-sink was configured.
+type benchmarkMetrics struct {
+	inputRecords       int
+	destinationRecords int
+	uniqueRecords      int
+	duplicates         int
+	percentLoss        float64
+	logDelaySeconds    float64
+}
+
+// emitMetrics reports the benchmark result through the configured
+// -metrics-sink, in addition to the result get_results always writes via
+// reportResult.
+func emitMetrics(metrics benchmarkMetrics) {
+	switch metricsConfig.sink {
+	case "cloudwatch":
+		if err := putCloudWatchMetrics(metrics); err != nil {
+			fmt.Fprintln(diagOut(), "[TEST ERROR] Unable to put CloudWatch metrics:", err)
+		}
+	case "prometheus":
+		servePrometheusMetrics(metrics)
+	case "stdout", "":
+		// Already reported by reportResult; nothing further to do.
+	default:
+		fmt.Fprintf(diagOut(), "[TEST ERROR] Unknown -metrics-sink %q, skipping metrics emission\n", metricsConfig.sink)
+	}
+}
+
+// Creates a new CloudWatch (metrics) Client
+func getCloudWatchMetricsClient(region string) (*cloudwatch.CloudWatch, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cloudwatch.New(sess), nil
+}
+
+// putCloudWatchMetrics publishes the benchmark result as custom CloudWatch
+// metrics under metricsConfig.namespace, dimensioned by Destination, Prefix
+// and Region so runs can be trended and compared across CI builds.
+func putCloudWatchMetrics(metrics benchmarkMetrics) error {
+	cwClient, err := getCloudWatchMetricsClient(metricsConfig.region)
+	if err != nil {
+		return err
+	}
+
+	dimensions := []*cloudwatch.Dimension{
+		{Name: aws.String("Destination"), Value: aws.String(metricsConfig.destination)},
+		{Name: aws.String("Prefix"), Value: aws.String(metricsConfig.prefix)},
+		{Name: aws.String("Region"), Value: aws.String(metricsConfig.region)},
+	}
+
+	data := []*cloudwatch.MetricDatum{
+		{MetricName: aws.String("InputRecords"), Value: aws.Float64(float64(metrics.inputRecords)), Dimensions: dimensions},
+		{MetricName: aws.String("DestinationRecords"), Value: aws.Float64(float64(metrics.destinationRecords)), Dimensions: dimensions},
+		{MetricName: aws.String("UniqueRecords"), Value: aws.Float64(float64(metrics.uniqueRecords)), Dimensions: dimensions},
+		{MetricName: aws.String("Duplicates"), Value: aws.Float64(float64(metrics.duplicates)), Dimensions: dimensions},
+		{MetricName: aws.String("PercentLoss"), Value: aws.Float64(metrics.percentLoss), Dimensions: dimensions},
+		{MetricName: aws.String("LogDelaySeconds"), Value: aws.Float64(metrics.logDelaySeconds), Dimensions: dimensions},
+	}
+
+	_, err = cwClient.PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String(metricsConfig.namespace),
+		MetricData: data,
+	})
+
+	return err
+}
+
+// servePrometheusMetrics registers the benchmark result as Prometheus
+// gauges and exposes them on /metrics until metricsConfig.hold elapses, so a
+// scrape job or pushgateway has time to collect them.
+func servePrometheusMetrics(metrics benchmarkMetrics) {
+	registry := prometheus.NewRegistry()
+
+	gauges := map[string]float64{
+		"fluentbit_loadtest_input_records":       float64(metrics.inputRecords),
+		"fluentbit_loadtest_destination_records": float64(metrics.destinationRecords),
+		"fluentbit_loadtest_unique_records":      float64(metrics.uniqueRecords),
+		"fluentbit_loadtest_duplicates":          float64(metrics.duplicates),
+		"fluentbit_loadtest_percent_loss":        metrics.percentLoss,
+		"fluentbit_loadtest_log_delay_seconds":   metrics.logDelaySeconds,
+	}
+
+	for name, value := range gauges {
+		gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: name})
+		gauge.Set(value)
+		registry.MustRegister(gauge)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	server := &http.Server{Addr: metricsConfig.addr, Handler: mux}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	fmt.Fprintf(diagOut(), "Serving Prometheus metrics on %s/metrics for %s\n", metricsConfig.addr, metricsConfig.hold)
+
+	select {
+	case err := <-serveErr:
+		if err != nil && err != http.ErrServerClosed {
+			exitErrorf("[TEST FAILURE] Prometheus metrics server failed to serve on %s: %v", metricsConfig.addr, err)
+		}
+		return
+	case <-time.After(metricsConfig.hold):
+	}
+
+	server.Close()
+}
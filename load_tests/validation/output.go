@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// diagOut returns where human-readable diagnostic lines (worker throughput,
+// total_s3_obj, approximate-mode notes, ...) should go. In -output json
+// mode they're routed to stderr so stdout stays a single parseable JSON
+// object; otherwise they go to stdout alongside the rest of the summary.
+func diagOut() io.Writer {
+	if outputConfig.format == "json" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// benchmarkOutputConfig holds the -output*, -max-*, and -missing-ids-file
+// flag values.
+type benchmarkOutputConfig struct {
+	format              string
+	file                string
+	maxLossPercent      float64
+	maxDuplicatePercent float64
+	maxDelay            float64
+	missingIdsFile      string
+	destination         string
+	prefix              string
+}
+
+var outputConfig benchmarkOutputConfig
+
+// benchmarkResult is the structured form of a validation run's result,
+// mirrored by the -output json representation.
+type benchmarkResult struct {
+	totalInput       int
+	totalDestination int
+	unique           int
+	duplicates       int
+	percentLoss      float64
+	missing          int
+	delaySeconds     float64
+	destination      string
+	prefix           string
+	durationSeconds  float64
+	throughputRps    float64
+}
+
+// benchmarkResultJSON is the JSON wire format for -output json, with the
+// field names called out in the CI tooling that consumes it.
+type benchmarkResultJSON struct {
+	TotalInput       int     `json:"total_input"`
+	TotalDestination int     `json:"total_destination"`
+	Unique           int     `json:"unique"`
+	Duplicates       int     `json:"duplicates"`
+	PercentLoss      float64 `json:"percent_loss"`
+	Missing          int     `json:"missing"`
+	DelaySeconds     float64 `json:"delay_seconds"`
+	Destination      string  `json:"destination"`
+	Prefix           string  `json:"prefix"`
+	DurationSeconds  float64 `json:"duration_seconds"`
+	ThroughputRps    float64 `json:"throughput_rps"`
+}
+
+// reportResult writes the result in the configured -output format, to
+// -output-file if set or stdout otherwise.
+func reportResult(result benchmarkResult) {
+	var out *os.File = os.Stdout
+	if outputConfig.file != "" {
+		file, err := os.Create(outputConfig.file)
+		if err != nil {
+			exitErrorf("[TEST FAILURE] Unable to create -output-file %q: %v", outputConfig.file, err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if outputConfig.format == "json" {
+		writeJSONResult(out, result)
+		return
+	}
+
+	fmt.Fprintln(out, "total_input, ", result.totalInput)
+	fmt.Fprintln(out, "total_destination, ", result.totalDestination)
+	fmt.Fprintln(out, "unique, ", result.unique)
+	fmt.Fprintln(out, "duplicate, ", result.duplicates)
+	fmt.Fprintln(out, "delay, ", result.delaySeconds)
+	fmt.Fprintln(out, "percent_loss, ", int(result.percentLoss)) // %
+	fmt.Fprintln(out, "missing, ", result.missing)
+}
+
+func writeJSONResult(out *os.File, result benchmarkResult) {
+	encoded, err := json.Marshal(benchmarkResultJSON{
+		TotalInput:       result.totalInput,
+		TotalDestination: result.totalDestination,
+		Unique:           result.unique,
+		Duplicates:       result.duplicates,
+		PercentLoss:      result.percentLoss,
+		Missing:          result.missing,
+		DelaySeconds:     result.delaySeconds,
+		Destination:      result.destination,
+		Prefix:           result.prefix,
+		DurationSeconds:  result.durationSeconds,
+		ThroughputRps:    result.throughputRps,
+	})
+	if err != nil {
+		exitErrorf("[TEST FAILURE] Unable to marshal JSON result: %v", err)
+	}
+
+	fmt.Fprintln(out, string(encoded))
+}
+
+// writeMissingIdsFile dumps the sorted list of record IDs present in the
+// input (the [idCounterBase, idCounterBase+totalInputRecord) range our log
+// producer generates) but absent from inputMap, so a failed run is
+// debuggable without re-deriving the missing set by hand.
+func writeMissingIdsFile(totalInputRecord int) {
+	if outputConfig.missingIdsFile == "" {
+		return
+	}
+	if approxConfig.mode == "approximate" && !approxConfig.useExact {
+		fmt.Fprintln(diagOut(), "[TEST ERROR] -missing-ids-file requires exact IDs; run is in full approximate mode (over -exact-threshold), skipping")
+		return
+	}
+
+	var missingIds []uint32
+	inputMapMu.Lock()
+	for i := 0; i < totalInputRecord; i++ {
+		id := uint32(idCounterBase + i)
+		if _, ok := inputMap[id]; !ok {
+			missingIds = append(missingIds, id)
+		}
+	}
+	inputMapMu.Unlock()
+
+	sort.Slice(missingIds, func(i, j int) bool { return missingIds[i] < missingIds[j] })
+
+	file, err := os.Create(outputConfig.missingIdsFile)
+	if err != nil {
+		fmt.Fprintln(diagOut(), "[TEST ERROR] Unable to create -missing-ids-file:", err)
+		return
+	}
+	defer file.Close()
+
+	for _, id := range missingIds {
+		fmt.Fprintln(file, id)
+	}
+}
+
+// slo describes a single-threshold failure from enforceThresholds.
+type slo struct {
+	Reason    string  `json:"reason"`
+	Threshold float64 `json:"threshold"`
+	Actual    float64 `json:"actual"`
+}
+
+// enforceThresholds exits non-zero with a machine-readable failure reason
+// when the result violates any of the -max-* thresholds, so CI can gate on
+// it. Thresholds below zero are treated as disabled.
+func enforceThresholds(result benchmarkResult) {
+	var violations []slo
+
+	if outputConfig.maxLossPercent >= 0 && result.percentLoss > outputConfig.maxLossPercent {
+		violations = append(violations, slo{"percent_loss", outputConfig.maxLossPercent, result.percentLoss})
+	}
+
+	duplicatePercent := float64(0)
+	if result.totalDestination > 0 {
+		duplicatePercent = float64(result.duplicates) * 100 / float64(result.totalDestination)
+	}
+	if outputConfig.maxDuplicatePercent >= 0 && duplicatePercent > outputConfig.maxDuplicatePercent {
+		violations = append(violations, slo{"duplicate_percent", outputConfig.maxDuplicatePercent, duplicatePercent})
+	}
+
+	if outputConfig.maxDelay >= 0 && result.delaySeconds > outputConfig.maxDelay {
+		violations = append(violations, slo{"delay_seconds", outputConfig.maxDelay, result.delaySeconds})
+	}
+
+	if len(violations) == 0 {
+		return
+	}
+
+	encoded, _ := json.Marshal(violations)
+	fmt.Fprintln(os.Stderr, "[TEST FAILURE] SLO violation(s):", string(encoded))
+	os.Exit(1)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// visibilityTimeoutExtension is how long we extend a message's visibility
+// timeout while we're still fetching and decoding the S3 object it refers
+// to, so a slow GetObject doesn't cause SQS to redeliver the message.
+const visibilityTimeoutExtension = 120
+
+// s3EventNotification is the subset of the S3 ObjectCreated event
+// notification body (as delivered via SQS) that we care about.
+type s3EventNotification struct {
+	Records []struct {
+		S3 struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// Creates a new SQS Client
+func getSQSClient(region string) (*sqs.SQS, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sqs.New(sess), nil
+}
+
+// validate_sqs_s3 long-polls queueUrl for S3 ObjectCreated:* event
+// notifications and validates each object as it lands, instead of listing a
+// prefix after a fixed sleep. This gives near-real-time delay measurements
+// since an object is validated the moment Firehose finishes flushing it.
+// Ingestion is considered complete once idleTimeout elapses with no new
+// messages.
+func validate_sqs_s3(sqsClient *sqs.SQS, s3Client *s3.S3, queueUrl string, idleTimeout time.Duration) int {
+	recordCounter := 0
+	lastMessageAt := time.Now()
+
+	for time.Since(lastMessageAt) < idleTimeout {
+		receiveInput := &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueUrl),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+			VisibilityTimeout:   aws.Int64(visibilityTimeoutExtension),
+		}
+
+		response, err := sqsClient.ReceiveMessage(receiveInput)
+		if err != nil {
+			exitErrorf("[TEST FAILURE] Error occurred receiving messages from queue: %q., %v", queueUrl, err)
+		}
+
+		if len(response.Messages) == 0 {
+			continue
+		}
+		lastMessageAt = time.Now()
+
+		for _, msg := range response.Messages {
+			keys, err := parseS3EventKeys(aws.StringValue(msg.Body))
+			if err != nil {
+				fmt.Fprintln(diagOut(), "[TEST ERROR] Unable to parse S3 event notification:", err)
+				continue
+			}
+
+			allValidated := true
+			for _, key := range keys {
+				// Extend the visibility timeout before a potentially slow
+				// GetObject call so the message isn't redelivered mid-flight.
+				sqsClient.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(queueUrl),
+					ReceiptHandle:     msg.ReceiptHandle,
+					VisibilityTimeout: aws.Int64(visibilityTimeoutExtension),
+				})
+
+				n, err := fetchAndCountS3Object(s3Client, key.bucket, key.key)
+				if err != nil {
+					fmt.Fprintln(diagOut(), "[TEST ERROR] Unable to validate S3 object:", err)
+					allValidated = false
+					continue
+				}
+				recordCounter += n
+			}
+			if !allValidated {
+				continue
+			}
+
+			// Ack the message by deleting it now that every object it
+			// referenced has been validated.
+			_, err = sqsClient.DeleteMessage(&sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(queueUrl),
+				ReceiptHandle: msg.ReceiptHandle,
+			})
+			if err != nil {
+				fmt.Fprintln(diagOut(), "[TEST ERROR] Unable to delete SQS message:", err)
+			}
+		}
+	}
+
+	return recordCounter
+}
+
+type s3ObjectKey struct {
+	bucket string
+	key    string
+}
+
+// parseS3EventKeys extracts the bucket/key pairs from an S3 ObjectCreated
+// event notification body.
+func parseS3EventKeys(body string) ([]s3ObjectKey, error) {
+	var notification s3EventNotification
+	if err := json.Unmarshal([]byte(body), &notification); err != nil {
+		return nil, err
+	}
+
+	keys := make([]s3ObjectKey, 0, len(notification.Records))
+	for _, record := range notification.Records {
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			// Fall back to the raw key rather than dropping the record;
+			// GetObject will surface a clearer error if it's truly wrong.
+			key = record.S3.Object.Key
+		}
+
+		keys = append(keys, s3ObjectKey{
+			bucket: record.S3.Bucket.Name,
+			key:    key,
+		})
+	}
+
+	return keys, nil
+}
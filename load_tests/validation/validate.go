@@ -1,19 +1,24 @@
 package main
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
@@ -21,9 +26,26 @@ const (
 )
 
 var (
-	inputMap map[uint32]struct{}
+	inputMap   map[uint32]struct{}
+	inputMapMu sync.Mutex
 )
 
+// workerStats tracks how many records each S3 fetch worker processed and how
+// long it spent, so we can report per-worker throughput alongside the
+// aggregate result.
+type workerStats struct {
+	workerID int
+	records  int
+	elapsed  time.Duration
+}
+
+// s3Stats holds the timing data gathered by the last validate_s3 run so that
+// get_results can report it alongside the standard summary.
+var s3Stats struct {
+	wallTime time.Duration
+	workers  []workerStats
+}
+
 type Message struct {
 	Log string
 }
@@ -37,6 +59,25 @@ func main() {
 	destination := flag.String("destination", "", "Log Destination (s3 or cloudwatch)")
 	inputRecord := flag.Int("input-record", 0, "Total input record number")
 	logDelay := flag.String("log-delay", "", "Log delay")
+	concurrency := flag.Int("concurrency", 1, "Number of worker goroutines used to fetch S3 objects in parallel")
+	queueUrl := flag.String("queue-url", "", "SQS Queue URL receiving S3 ObjectCreated notifications (sqs-s3 destination)")
+	idleTimeout := flag.Duration("idle-timeout", 60*time.Second, "How long to wait for new SQS messages before concluding ingestion is complete (sqs-s3 destination)")
+	streamName := flag.String("stream-name", "", "Kinesis Data Stream name (kinesis destination)")
+	deliveryStreamName := flag.String("delivery-stream-name", "", "Kinesis Firehose delivery stream name (firehose destination)")
+	shardIdleTimeout := flag.Duration("shard-idle-timeout", 30*time.Second, "How long to wait on a shard with no new records, once caught up to the stream tip, before concluding ingestion is complete (kinesis destination)")
+	metricsSink := flag.String("metrics-sink", "stdout", "Where to report benchmark metrics: stdout, cloudwatch, or prometheus")
+	metricsNamespace := flag.String("metrics-namespace", "FluentBitLoadTest", "CloudWatch namespace for benchmark metrics (cloudwatch metrics sink)")
+	metricsAddr := flag.String("metrics-addr", ":9090", "Address to expose Prometheus /metrics on (prometheus metrics sink)")
+	metricsHold := flag.Duration("metrics-hold", 30*time.Second, "How long to keep /metrics up for scraping before exiting (prometheus metrics sink)")
+	output := flag.String("output", "text", "Result output format: text or json")
+	outputFile := flag.String("output-file", "", "File to write the result to instead of stdout")
+	maxLossPercent := flag.Float64("max-loss-percent", -1, "Exit non-zero if percent_loss exceeds this threshold (disabled if < 0)")
+	maxDuplicatePercent := flag.Float64("max-duplicate-percent", -1, "Exit non-zero if the duplicate percentage exceeds this threshold (disabled if < 0)")
+	maxDelay := flag.Float64("max-delay", -1, "Exit non-zero if delay_seconds exceeds this threshold (disabled if < 0)")
+	missingIdsFile := flag.String("missing-ids-file", "", "File to write the sorted list of missing record IDs to")
+	mode := flag.String("mode", "exact", "Validation counting mode: exact or approximate")
+	exactThreshold := flag.Int("exact-threshold", 10000000, "Below this input-record count, also maintain exact counts alongside the HyperLogLog/Bloom sketches (mode approximate)")
+	bloomFpr := flag.Float64("bloom-fpr", 0.01, "Target false-positive rate for the duplicate-estimation Bloom filter (mode approximate)")
 
 	// Parse flags
 	flag.Parse()
@@ -63,9 +104,56 @@ func main() {
 	if *logDelay == "" {
 		exitErrorf("[TEST FAILURE] Log delay required. Use the -log-delay flag.")
 	}
+	if *destination == "sqs-s3" && *queueUrl == "" {
+		exitErrorf("[TEST FAILURE] SQS queue URL required for sqs-s3 destination. Use the -queue-url flag.")
+	}
+	if *destination == "kinesis" && *streamName == "" {
+		exitErrorf("[TEST FAILURE] Kinesis stream name required for kinesis destination. Use the -stream-name flag.")
+	}
+	if *destination == "firehose" && *deliveryStreamName == "" {
+		exitErrorf("[TEST FAILURE] Firehose delivery stream name required for firehose destination. Use the -delivery-stream-name flag.")
+	}
 
-	// Map for counting unique records in corresponding destination
-	inputMap = make(map[uint32]struct{}, *inputRecord)
+	metricsConfig = benchmarkMetricsConfig{
+		sink:        *metricsSink,
+		namespace:   *metricsNamespace,
+		addr:        *metricsAddr,
+		hold:        *metricsHold,
+		region:      *region,
+		destination: *destination,
+		prefix:      *prefix,
+	}
+
+	outputConfig = benchmarkOutputConfig{
+		format:              *output,
+		file:                *outputFile,
+		maxLossPercent:      *maxLossPercent,
+		maxDuplicatePercent: *maxDuplicatePercent,
+		maxDelay:            *maxDelay,
+		missingIdsFile:      *missingIdsFile,
+		destination:         *destination,
+		prefix:              *prefix,
+	}
+
+	runStart := time.Now()
+
+	approxConfig = approximateConfig{
+		mode:           *mode,
+		exactThreshold: *exactThreshold,
+	}
+	if *mode == "approximate" {
+		initApproximateTracking(*inputRecord, *bloomFpr)
+	}
+
+	// Map for counting unique records in corresponding destination. Not
+	// pre-sized when running in full approximate mode, where recordSeen never
+	// adds to it, since the whole point is avoiding an exact set for very
+	// large runs.
+	if approxConfig.mode != "approximate" || approxConfig.useExact {
+		inputMap = make(map[uint32]struct{}, *inputRecord)
+	} else {
+		inputMap = make(map[uint32]struct{})
+	}
 
 	totalRecordFound := 0
 	if *destination == "s3" {
@@ -74,7 +162,7 @@ func main() {
 			exitErrorf("[TEST FAILURE] Unable to create new S3 client: %v", err)
 		}
 
-		totalRecordFound = validate_s3(s3Client, *bucket, *prefix)
+		totalRecordFound = validate_s3(s3Client, *bucket, *prefix, *concurrency)
 	} else if *destination == "cloudwatch" {
 		cwClient, err := getCWClient(*region)
 		if err != nil {
@@ -82,10 +170,39 @@ func main() {
 		}
 
 		totalRecordFound = validate_cloudwatch(cwClient, *logGroup, *prefix)
+	} else if *destination == "sqs-s3" {
+		s3Client, err := getS3Client(*region)
+		if err != nil {
+			exitErrorf("[TEST FAILURE] Unable to create new S3 client: %v", err)
+		}
+		sqsClient, err := getSQSClient(*region)
+		if err != nil {
+			exitErrorf("[TEST FAILURE] Unable to create new SQS client: %v", err)
+		}
+
+		totalRecordFound = validate_sqs_s3(sqsClient, s3Client, *queueUrl, *idleTimeout)
+	} else if *destination == "kinesis" {
+		kinesisClient, err := getKinesisClient(*region)
+		if err != nil {
+			exitErrorf("[TEST FAILURE] Unable to create new Kinesis client: %v", err)
+		}
+
+		totalRecordFound = validate_kinesis(kinesisClient, *streamName, *shardIdleTimeout)
+	} else if *destination == "firehose" {
+		firehoseClient, err := getFirehoseClient(*region)
+		if err != nil {
+			exitErrorf("[TEST FAILURE] Unable to create new Firehose client: %v", err)
+		}
+		s3Client, err := getS3Client(*region)
+		if err != nil {
+			exitErrorf("[TEST FAILURE] Unable to create new S3 client: %v", err)
+		}
+
+		totalRecordFound = validate_firehose(firehoseClient, s3Client, *deliveryStreamName, *prefix, *concurrency)
 	}
 
 	// Get benchmark results based on log loss, log delay and log duplication
-	get_results(*inputRecord, totalRecordFound, *logDelay)
+	get_results(*inputRecord, totalRecordFound, *logDelay, time.Since(runStart))
 }
 
 // Creates a new S3 Client
@@ -105,14 +222,31 @@ func getS3Client(region string) (*s3.S3, error) {
 // Log format generated by our producer: 8CharUniqueID_13CharTimestamp_RandomString (10029999_1639151827578_RandomString).
 // Both of the Kinesis Streams and Kinesis Firehose try to send each log maintaining the "at least once" policy.
 // To validate, we need to make sure all the log records from input file are stored at least once.
-func validate_s3(s3Client *s3.S3, bucket string, prefix string) int {
-	var continuationToken *string
-	var input *s3.ListObjectsV2Input
-	s3RecordCounter := 0
-	s3ObjectCounter := 0
+func validate_s3(s3Client *s3.S3, bucket string, prefix string, concurrency int) int {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	start := time.Now()
+
+	keys := make(chan string, 1000)
+	results := make(chan workerStats, concurrency)
+	var s3ObjectCounter int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			records, elapsed := s3FetchWorker(s3Client, bucket, keys, &s3ObjectCounter)
+			results <- workerStats{workerID: workerID, records: records, elapsed: elapsed}
+		}(i)
+	}
 
+	// Page through the bucket listing and feed keys to the worker pool.
+	var continuationToken *string
 	for {
-		input = &s3.ListObjectsV2Input{
+		input := &s3.ListObjectsV2Input{
 			Bucket:            aws.String(bucket),
 			ContinuationToken: continuationToken,
 			Prefix:            aws.String(prefix),
@@ -124,42 +258,7 @@ func validate_s3(s3Client *s3.S3, bucket string, prefix string) int {
 		}
 
 		for _, content := range response.Contents {
-			input := &s3.GetObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    content.Key,
-			}
-			obj, err := s3Client.GetObject(input)
-			if err != nil {
-				exitErrorf("[TEST FAILURE] Error to get S3 object. %v", err)
-			}
-			s3ObjectCounter++
-
-			// Directly unmarshal the JSON objects from the S3 object body
-			decoder := json.NewDecoder(obj.Body)
-			for {
-				var message Message
-				err := decoder.Decode(&message)
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					fmt.Println("[TEST ERROR] Malform log entry. Unmarshal Error:", err)
-					continue
-				}
-
-				recordId := message.Log[:8]
-				s3RecordCounter++
-				value, err := strconv.ParseUint(recordId, 10, 32)
-				if err != nil {
-					fmt.Println("[TEST ERROR] Malform log entry. ParseUint Error:", err)
-					continue
-				}
-				recordIdUint := uint32(value)
-				inputMap[recordIdUint] = struct{}{}
-			}
-
-			// Close the S3 object body
-			obj.Body.Close()
+			keys <- aws.StringValue(content.Key)
 		}
 
 		if !aws.BoolValue(response.IsTruncated) {
@@ -167,12 +266,120 @@ func validate_s3(s3Client *s3.S3, bucket string, prefix string) int {
 		}
 		continuationToken = response.NextContinuationToken
 	}
+	close(keys)
 
-	fmt.Println("total_s3_obj, ", s3ObjectCounter)
+	wg.Wait()
+	close(results)
+
+	s3RecordCounter := 0
+	s3Stats.workers = s3Stats.workers[:0]
+	for r := range results {
+		s3RecordCounter += r.records
+		s3Stats.workers = append(s3Stats.workers, r)
+	}
+	s3Stats.wallTime = time.Since(start)
+
+	fmt.Fprintln(diagOut(), "total_s3_obj, ", s3ObjectCounter)
 
 	return s3RecordCounter
 }
 
+// s3FetchWorker pulls keys off the shared channel until it's drained, fetching
+// and decoding each object before merging the record IDs into the shared
+// inputMap behind inputMapMu. It returns the number of records it processed
+// and the time it spent doing so, for per-worker throughput reporting.
+func s3FetchWorker(s3Client *s3.S3, bucket string, keys <-chan string, s3ObjectCounter *int64) (int, time.Duration) {
+	start := time.Now()
+	recordCounter := 0
+
+	for key := range keys {
+		n, err := fetchAndCountS3Object(s3Client, bucket, key)
+		if err != nil {
+			exitErrorf("[TEST FAILURE] Error to get S3 object. %v", err)
+		}
+		atomic.AddInt64(s3ObjectCounter, 1)
+		recordCounter += n
+	}
+
+	return recordCounter, time.Since(start)
+}
+
+// fetchAndCountS3Object downloads a single S3 object, transparently
+// decompressing it if needed, and merges every record ID it contains into
+// the shared inputMap. It returns the number of records found in the object.
+func fetchAndCountS3Object(s3Client *s3.S3, bucket string, key string) (int, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	obj, err := s3Client.GetObject(input)
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Body.Close()
+
+	reader, err := decompressingReader(key, obj.Body)
+	if err != nil {
+		return 0, fmt.Errorf("unable to decompress S3 object %q: %v", key, err)
+	}
+	defer reader.Close()
+
+	recordCounter := 0
+
+	// Directly unmarshal the JSON objects from the (possibly decompressed) object body
+	decoder := json.NewDecoder(reader)
+	for {
+		var message Message
+		err := decoder.Decode(&message)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(diagOut(), "[TEST ERROR] Malform log entry. Unmarshal Error:", err)
+			continue
+		}
+
+		recordId := message.Log[:8]
+		recordCounter++
+		value, err := strconv.ParseUint(recordId, 10, 32)
+		if err != nil {
+			fmt.Fprintln(diagOut(), "[TEST ERROR] Malform log entry. ParseUint Error:", err)
+			continue
+		}
+		recordIdUint := uint32(value)
+		recordSeen(recordIdUint)
+	}
+
+	return recordCounter, nil
+}
+
+// decompressingReader wraps body in a gzip or zstd reader based on the
+// object key's extension, auto-detecting the Firehose-default .gz and
+// .zstd suffixes. Uncompressed objects are returned unwrapped.
+func decompressingReader(key string, body io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(key, ".gz"):
+		return gzip.NewReader(body)
+	case strings.HasSuffix(key, ".zstd"), strings.HasSuffix(key, ".zst"):
+		decoder, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		// zstd.NewReader spawns background goroutines/buffers that are only
+		// released on Close, so the caller must close this alongside obj.Body.
+		return decoder.IOReadCloser(), nil
+	default:
+		return io.NopCloser(body), nil
+	}
+}
+
+func recordsPerSecond(records int, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(records) / elapsed.Seconds()
+}
+
 func processFile(file *os.File, filePath string) (int, error) {
 	var err error
 	file, err = os.Open(filePath)
@@ -269,12 +476,12 @@ func validate_cloudwatch(cwClient *cloudwatchlogs.CloudWatchLogs, logGroup strin
 			recordId := log[:8]
 			value, err := strconv.ParseUint(recordId, 10, 32)
 			if err != nil {
-				fmt.Println("Error:", err)
+				fmt.Fprintln(diagOut(), "[TEST ERROR] Malform log entry. ParseUint Error:", err)
 				continue
 			}
 			recordIdUint := uint32(value)
 			cwRecoredCounter += 1
-			inputMap[recordIdUint] = struct{}{}
+			recordSeen(recordIdUint)
 		}
 
 		// Same NextForwardToken will be returned if we reach the end of the log stream
@@ -288,21 +495,80 @@ func validate_cloudwatch(cwClient *cloudwatchlogs.CloudWatchLogs, logGroup strin
 	return cwRecoredCounter
 }
 
-func get_results(totalInputRecord int, totalRecordFound int, logDelay string) {
+func get_results(totalInputRecord int, totalRecordFound int, logDelay string, duration time.Duration) {
 	uniqueRecordFound := len(inputMap)
+	if approxConfig.mode == "approximate" {
+		approxUnique := approxConfig.hll.estimate()
+		if approxConfig.useExact {
+			fmt.Fprintln(diagOut(), "unique_exact, ", uniqueRecordFound)
+			fmt.Fprintln(diagOut(), "unique_approximate, ", int(math.Round(approxUnique)))
+			fmt.Fprintln(diagOut(), "mode_used, exact (run under -exact-threshold)")
+		} else {
+			uniqueRecordFound = int(math.Round(approxUnique))
+			fmt.Fprintln(diagOut(), "unique_approximate, ", uniqueRecordFound)
+			fmt.Fprintln(diagOut(), "duplicate_estimate, ", atomic.LoadInt64(&approxConfig.duplicateEstimate))
+			fmt.Fprintln(diagOut(), "mode_used, approximate (HyperLogLog++/Bloom)")
+		}
+	}
 
-	fmt.Println("total_input, ", totalInputRecord)
-	fmt.Println("total_destination, ", totalRecordFound)
-	fmt.Println("unique, ", uniqueRecordFound)
-	fmt.Println("duplicate, ", (totalRecordFound - uniqueRecordFound))
-	fmt.Println("delay, ", logDelay)
-	fmt.Println("percent_loss, ", (totalInputRecord-uniqueRecordFound)*100/totalInputRecord) // %
+	duplicates := totalRecordFound - uniqueRecordFound
+	if approxConfig.mode == "approximate" && !approxConfig.useExact {
+		// The HLL estimate can over-estimate unique records, which would
+		// make totalRecordFound-uniqueRecordFound negative; the Bloom
+		// filter's duplicate_estimate is the number we actually have.
+		duplicates = int(atomic.LoadInt64(&approxConfig.duplicateEstimate))
+	}
+	if duplicates < 0 {
+		duplicates = 0
+	}
+	missing := 0
+	if totalInputRecord > uniqueRecordFound {
+		missing = totalInputRecord - uniqueRecordFound
+	}
+	percentLoss := float64((totalInputRecord-uniqueRecordFound)*100) / float64(totalInputRecord)
+	if percentLoss < 0 {
+		percentLoss = 0
+	}
+	delaySeconds, err := strconv.ParseFloat(logDelay, 64)
+	if err != nil {
+		delaySeconds = 0
+	}
+	throughputRps := float64(uniqueRecordFound) / duration.Seconds()
+
+	result := benchmarkResult{
+		totalInput:       totalInputRecord,
+		totalDestination: totalRecordFound,
+		unique:           uniqueRecordFound,
+		duplicates:       duplicates,
+		percentLoss:      percentLoss,
+		missing:          missing,
+		delaySeconds:     delaySeconds,
+		destination:      outputConfig.destination,
+		prefix:           outputConfig.prefix,
+		durationSeconds:  duration.Seconds(),
+		throughputRps:    throughputRps,
+	}
 
-	if totalInputRecord != uniqueRecordFound {
-		fmt.Println("missing, ", totalInputRecord-uniqueRecordFound)
-	} else {
-		fmt.Println("missing, ", 0)
+	reportResult(result)
+
+	if len(s3Stats.workers) > 0 {
+		for _, w := range s3Stats.workers {
+			fmt.Fprintf(diagOut(), "worker_%d_throughput, %.2f records/sec\n", w.workerID, recordsPerSecond(w.records, w.elapsed))
+		}
+		fmt.Fprintln(diagOut(), "total_wall_time, ", s3Stats.wallTime)
 	}
+
+	emitMetrics(benchmarkMetrics{
+		inputRecords:       totalInputRecord,
+		destinationRecords: totalRecordFound,
+		uniqueRecords:      uniqueRecordFound,
+		duplicates:         duplicates,
+		percentLoss:        percentLoss,
+		logDelaySeconds:    delaySeconds,
+	})
+
+	writeMissingIdsFile(totalInputRecord)
+	enforceThresholds(result)
 }
 
 func exitErrorf(msg string, args ...interface{}) {